@@ -0,0 +1,109 @@
+// Copyright 2020 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// EnsureClusterBridge creates (if needed) a Linux bridge carrying the
+// given gateway address, so that tap devices attached to it via
+// AttachClusterTap can actually reach each other. This is the "shared
+// bridge" half of --cluster-network; it's plain "ip" commands rather
+// than a full CNI plugin invocation, since every member is a sibling
+// qemu process on the same host rather than a separate container.
+func EnsureClusterBridge(name, gatewayCIDR string) error {
+	if err := exec.Command("ip", "link", "show", name).Run(); err == nil {
+		return nil
+	}
+	if err := run("ip", "link", "add", "name", name, "type", "bridge"); err != nil {
+		return errors.Wrapf(err, "creating bridge %s", name)
+	}
+	if err := run("ip", "addr", "add", gatewayCIDR, "dev", name); err != nil {
+		return errors.Wrapf(err, "assigning %s to bridge %s", gatewayCIDR, name)
+	}
+	if err := run("ip", "link", "set", name, "up"); err != nil {
+		return errors.Wrapf(err, "bringing up bridge %s", name)
+	}
+	return nil
+}
+
+// DeleteClusterBridge tears down a bridge created by EnsureClusterBridge.
+func DeleteClusterBridge(name string) error {
+	return run("ip", "link", "delete", name)
+}
+
+// AttachClusterTap allocates a tap device named ifName, attaches it to
+// bridge, and returns the open fd for qemu's -netdev tap,fd=...; the
+// caller keeps ifName to tear the device down later via DetachClusterTap.
+func AttachClusterTap(bridge, ifName string) (*os.File, error) {
+	if len(ifName) >= unix.IFNAMSIZ {
+		return nil, errors.Errorf("interface name %q too long", ifName)
+	}
+
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening /dev/net/tun")
+	}
+
+	var req ifReq
+	copy(req.Name[:], ifName)
+	req.Flags = unix.IFF_TAP | unix.IFF_NO_PI
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); errno != 0 {
+		unix.Close(fd)
+		return nil, errors.Wrapf(errno, "TUNSETIFF on %s", ifName)
+	}
+
+	if err := run("ip", "link", "set", ifName, "master", bridge); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrapf(err, "attaching %s to bridge %s", ifName, bridge)
+	}
+	if err := run("ip", "link", "set", ifName, "up"); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrapf(err, "bringing up %s", ifName)
+	}
+
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
+
+// DetachClusterTap removes a tap device created by AttachClusterTap.
+func DetachClusterTap(ifName string) error {
+	return run("ip", "link", "delete", ifName)
+}
+
+// AddTapFd wires an already-open tap fd (from AttachClusterTap or
+// equivalent) into the qemu command line with a fixed MAC, mirroring
+// what EnableCNINetworking does for a single CNI-managed tap.
+func (builder *QemuBuilder) AddTapFd(tap *os.File, mac string) {
+	id := fmt.Sprintf("cluster%d", tap.Fd())
+	builder.appendFd(id, tap)
+	builder.Append("-netdev", fmt.Sprintf("tap,id=%s,fd=%d", id, builder.lastFdNum()))
+	builder.Append("-device", fmt.Sprintf("virtio-net-pci,netdev=%s,mac=%s", id, mac))
+}
+
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, args, err, out)
+	}
+	return nil
+}
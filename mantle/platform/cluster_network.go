@@ -0,0 +1,87 @@
+// Copyright 2020 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// ClusterNode is one member of a ClusterNetwork: the hostname, MAC and IP
+// it was allocated, and the host-side SSH port it'll be reachable on.
+type ClusterNode struct {
+	Role     string `json:"role"`
+	Hostname string `json:"hostname"`
+	MAC      string `json:"mac"`
+	IP       string `json:"ip"`
+	SSHPort  int    `json:"sshPort"`
+	PID      int    `json:"pid"`
+}
+
+// ClusterNetwork allocates addressing for a set of QemuBuilders that need
+// to talk to each other over the shared Linux bridge set up by
+// EnsureClusterBridge. That bridge is plain "ip" commands, not a CNI
+// plugin chain; nodes on per-instance slirp networking don't use a
+// ClusterNetwork at all.
+type ClusterNetwork struct {
+	CIDR    string
+	network *net.IPNet
+	gateway net.IP
+	next    int
+}
+
+// NewClusterNetwork parses the --cluster-network CIDR and prepares to
+// hand out sequential addresses from it, reserving the first address for
+// the gateway.
+func NewClusterNetwork(cidr string) (*ClusterNetwork, error) {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing cluster network %q", cidr)
+	}
+	gw := make(net.IP, len(ip.To4()))
+	copy(gw, ip.To4())
+	gw[len(gw)-1]++
+	return &ClusterNetwork{CIDR: cidr, network: ipnet, gateway: gw, next: 2}, nil
+}
+
+// GatewayCIDR returns the address this network reserves for the bridge
+// itself, in ip-addr-add form, e.g. "192.168.76.1/24".
+func (n *ClusterNetwork) GatewayCIDR() string {
+	ones, _ := n.network.Mask.Size()
+	return fmt.Sprintf("%s/%d", n.gateway.String(), ones)
+}
+
+// Allocate hands out the next hostname/MAC/IP triple for a node with the
+// given role, e.g. "etcd-0".
+func (n *ClusterNetwork) Allocate(role string, index int) (ClusterNode, error) {
+	ip := make(net.IP, len(n.gateway))
+	copy(ip, n.gateway)
+	ip[len(ip)-1] = byte(n.next)
+	if !n.network.Contains(ip) {
+		return ClusterNode{}, errors.Errorf("cluster network %s exhausted", n.CIDR)
+	}
+	n.next++
+
+	hostname := fmt.Sprintf("%s-%d", role, index)
+	mac := fmt.Sprintf("52:54:00:12:%02x:%02x", (n.next>>8)&0xff, n.next&0xff)
+	return ClusterNode{
+		Role:     role,
+		Hostname: hostname,
+		MAC:      mac,
+		IP:       ip.String(),
+	}, nil
+}
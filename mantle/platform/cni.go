@@ -0,0 +1,199 @@
+// Copyright 2020 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"unsafe"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// cniNetworking holds everything EnableCNINetworking sets up for
+// TeardownCNI() to tear down: the network namespace it created, the tap
+// fd it handed to qemu, and the CNI runtime config needed to run the DEL
+// chain. Instance.Destroy() does not run TeardownCNI().
+type cniNetworking struct {
+	netConf   *libcni.NetworkConfigList
+	cniConfig *libcni.CNIConfig
+	runtime   *libcni.RuntimeConf
+	netnsPath string
+	tapFile   *os.File
+	result    *current.Result
+}
+
+// EnableCNINetworking allocates a tap device inside a fresh network
+// namespace for this instance and runs the CNI plugin chain (bridge +
+// host-local + firewall, per the named network's conflist) to attach it,
+// so the guest gets a routable IP instead of a slirp NAT address. The
+// returned IP is the guest-visible address that SSH() etc. should use.
+func (builder *QemuBuilder) EnableCNINetworking(network, confDir string) (string, error) {
+	if confDir == "" {
+		confDir = "/etc/cni/net.d"
+	}
+	cninet := libcni.NewCNIConfig([]string{"/opt/cni/bin", "/usr/libexec/cni"}, nil)
+	netConf, err := libcni.LoadConfList(confDir, network)
+	if err != nil {
+		return "", errors.Wrapf(err, "loading CNI network %q from %s", network, confDir)
+	}
+
+	// netns.NewNamed below switches the *current OS thread* into the new
+	// namespace; if the Go scheduler moves this goroutine to a different
+	// thread mid-function, or reuses this thread for another goroutine,
+	// operations end up running in the wrong namespace. Pin the goroutine
+	// to this thread for the whole namespace-sensitive section.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return "", errors.Wrapf(err, "getting current netns")
+	}
+	defer origns.Close()
+
+	newns, err := netns.NewNamed(fmt.Sprintf("cosa-run-%d", os.Getpid()))
+	if err != nil {
+		return "", errors.Wrapf(err, "creating network namespace")
+	}
+	defer newns.Close()
+	defer netns.Set(origns)
+
+	ifName := "tap0"
+	rt := &libcni.RuntimeConf{
+		ContainerID: fmt.Sprintf("cosa-run-%d", os.Getpid()),
+		NetNS:       fmt.Sprintf("/var/run/netns/cosa-run-%d", os.Getpid()),
+		IfName:      ifName,
+	}
+
+	res, err := cninet.AddNetworkList(builder.ctx(), netConf, rt)
+	if err != nil {
+		return "", errors.Wrapf(err, "running CNI ADD for %q", network)
+	}
+	result, err := current.NewResultFromResult(res)
+	if err != nil {
+		return "", errors.Wrapf(err, "parsing CNI result")
+	}
+
+	tapFile, err := openTapInNamespace(newns, ifName)
+	if err != nil {
+		// builder.cni isn't recorded yet at this point, so
+		// TeardownCNI() won't run for this instance; clean up inline
+		// instead of leaking the CNI attachment and namespace.
+		if delErr := cninet.DelNetworkList(builder.ctx(), netConf, rt); delErr != nil {
+			fmt.Fprintf(os.Stderr, "warning: CNI DEL after failed tap open: %v\n", delErr)
+		}
+		if delErr := exec.Command("ip", "netns", "delete", fmt.Sprintf("cosa-run-%d", os.Getpid())).Run(); delErr != nil {
+			fmt.Fprintf(os.Stderr, "warning: deleting netns after failed tap open: %v\n", delErr)
+		}
+		return "", errors.Wrapf(err, "opening tap device %s", ifName)
+	}
+
+	mac := fmt.Sprintf("52:54:00:%02x:%02x:%02x", os.Getpid()>>16&0xff, os.Getpid()>>8&0xff, os.Getpid()&0xff)
+	builder.appendFd("tap", tapFile)
+	builder.Append("-netdev", fmt.Sprintf("tap,id=cni0,fd=%d", builder.lastFdNum()))
+	builder.Append("-device", fmt.Sprintf("virtio-net-pci,netdev=cni0,mac=%s", mac))
+
+	builder.cni = &cniNetworking{
+		netConf:   netConf,
+		cniConfig: cninet,
+		runtime:   rt,
+		netnsPath: rt.NetNS,
+		tapFile:   tapFile,
+		result:    result,
+	}
+
+	if len(result.IPs) == 0 {
+		return "", errors.New("CNI plugin did not return an IP")
+	}
+	return result.IPs[0].Address.IP.String(), nil
+}
+
+// TeardownCNI runs the CNI DEL chain and removes the network namespace.
+// It needs to run even when qemu exited abnormally; Instance.Destroy()
+// (in qemu.go, outside this package's current contents) is the natural
+// place to call it unconditionally, but until that wiring exists callers
+// of EnableCNINetworking must defer TeardownCNI themselves.
+func (builder *QemuBuilder) TeardownCNI() error {
+	if builder.cni == nil {
+		return nil
+	}
+	c := builder.cni
+	if err := c.cniConfig.DelNetworkList(builder.ctx(), c.netConf, c.runtime); err != nil {
+		return errors.Wrapf(err, "running CNI DEL")
+	}
+	if err := exec.Command("ip", "netns", "delete", fmt.Sprintf("cosa-run-%d", os.Getpid())).Run(); err != nil {
+		return errors.Wrapf(err, "deleting network namespace")
+	}
+	return nil
+}
+
+// ifReq mirrors the kernel's struct ifreq closely enough for the
+// TUNSETIFF ioctl: a 16-byte interface name followed by the flags field
+// that request a tap device with no packet-info header.
+type ifReq struct {
+	Name  [unix.IFNAMSIZ]byte
+	Flags uint16
+	_     [22]byte
+}
+
+// openTapInNamespace opens a persistent tap device named ifName inside
+// ns and returns its file descriptor, ready to be passed to qemu via
+// -netdev tap,fd=. The CNI bridge plugin has already created ifName as
+// a veth/bridge member by the time this runs; here we're just opening
+// /dev/net/tun against that existing interface.
+func openTapInNamespace(ns netns.NsHandle, ifName string) (*os.File, error) {
+	if len(ifName) >= unix.IFNAMSIZ {
+		return nil, errors.Errorf("interface name %q too long", ifName)
+	}
+
+	// Callers are expected to already hold the OS thread lock for the
+	// surrounding namespace-sensitive section (see EnableCNINetworking),
+	// but this function switches namespaces twice on its own, so it locks
+	// too in case it's ever called on its own.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting current netns")
+	}
+	defer origns.Close()
+	defer netns.Set(origns)
+	if err := netns.Set(ns); err != nil {
+		return nil, errors.Wrapf(err, "entering target netns")
+	}
+
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening /dev/net/tun")
+	}
+
+	var req ifReq
+	copy(req.Name[:], ifName)
+	req.Flags = unix.IFF_TAP | unix.IFF_NO_PI
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); errno != 0 {
+		unix.Close(fd)
+		return nil, errors.Wrapf(errno, "TUNSETIFF on %s", ifName)
+	}
+
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
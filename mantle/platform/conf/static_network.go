@@ -0,0 +1,38 @@
+// Copyright 2020 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AddStaticNetwork injects a systemd-networkd .network unit matching the
+// guest's cluster NIC by MAC address and giving it a static ip/gateway,
+// for nodes launched by `cosa run --count`/--cluster-network where DHCP
+// isn't available.
+func (c *Conf) AddStaticNetwork(ip, gatewayCIDR, mac string) {
+	gateway, prefix := gatewayCIDR, "32"
+	if idx := strings.IndexByte(gatewayCIDR, '/'); idx != -1 {
+		gateway, prefix = gatewayCIDR[:idx], gatewayCIDR[idx+1:]
+	}
+	unit := fmt.Sprintf(`[Match]
+MACAddress=%s
+[Network]
+Address=%s/%s
+Gateway=%s
+`, mac, ip, prefix, gateway)
+	c.AddSystemdUnit("00-cluster.network", unit, "")
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MountVirtiofs injects a systemd.mount unit for a virtio-fs tag exported
+// by the host, analogous to Mount9p but using the "virtiofs" filesystem
+// type and the tag the host picked when it started virtiofsd.
+func (c *Conf) MountVirtiofs(dest string, readonly bool) {
+	unitName := unitNameForMount(dest)
+	opts := "defaults"
+	if readonly {
+		opts = "ro"
+	}
+	tag := virtiofsTagForMount(dest)
+	unit := fmt.Sprintf(`[Unit]
+Before=local-fs.target
+[Mount]
+What=%s
+Where=%s
+Type=virtiofs
+Options=%s
+[Install]
+WantedBy=local-fs.target
+`, tag, dest, opts)
+	c.AddSystemdUnit(unitName, unit, "enabled")
+}
+
+func unitNameForMount(dest string) string {
+	trimmed := strings.Trim(dest, "/")
+	return strings.ReplaceAll(trimmed, "/", "-") + ".mount"
+}
+
+// virtiofsTagForMount must match the tag QemuBuilder.MountVirtiofs
+// generates for the same destination on the host side.
+func virtiofsTagForMount(dest string) string {
+	return "virtiofs-" + strings.ReplaceAll(strings.Trim(dest, "/"), "/", "-")
+}
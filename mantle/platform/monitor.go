@@ -0,0 +1,149 @@
+// Copyright 2020 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"encoding/json"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Monitor is a small client for qemu's QMP control socket. It lets
+// callers script pause/resume, snapshot, device hotplug and graceful
+// shutdown from outside the guest, none of which is possible with just
+// Instance.Wait().
+type Monitor struct {
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+// DialMonitor connects to a QMP unix socket previously wired up via
+// QemuBuilder.QMPSocket (qemu must have been started with
+// -qmp unix:path,server,nowait) and performs the capabilities handshake.
+func DialMonitor(path string) (*Monitor, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dialing QMP socket %s", path)
+	}
+	m := &Monitor{conn: conn, dec: json.NewDecoder(conn)}
+
+	// qemu sends a greeting with its version/capabilities first.
+	var greeting map[string]interface{}
+	if err := m.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "reading QMP greeting")
+	}
+	if _, err := m.Query("qmp_capabilities", nil); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "negotiating QMP capabilities")
+	}
+	return m, nil
+}
+
+// Close closes the underlying QMP connection.
+func (m *Monitor) Close() error {
+	return m.conn.Close()
+}
+
+// Query issues an arbitrary QMP command and returns its "return" payload.
+func (m *Monitor) Query(cmd string, args map[string]interface{}) (json.RawMessage, error) {
+	req := map[string]interface{}{"execute": cmd}
+	if args != nil {
+		req["arguments"] = args
+	}
+	if err := json.NewEncoder(m.conn).Encode(req); err != nil {
+		return nil, errors.Wrapf(err, "sending QMP command %s", cmd)
+	}
+
+	for {
+		var resp struct {
+			Return json.RawMessage `json:"return"`
+			Error  *struct {
+				Class string `json:"class"`
+				Desc  string `json:"desc"`
+			} `json:"error"`
+			Event string `json:"event"`
+		}
+		if err := m.dec.Decode(&resp); err != nil {
+			return nil, errors.Wrapf(err, "reading QMP response to %s", cmd)
+		}
+		if resp.Event != "" {
+			// Asynchronous events (e.g. SHUTDOWN) can interleave with
+			// command replies; skip them and keep waiting for our reply.
+			continue
+		}
+		if resp.Error != nil {
+			return nil, errors.Errorf("QMP command %s failed: %s: %s", cmd, resp.Error.Class, resp.Error.Desc)
+		}
+		return resp.Return, nil
+	}
+}
+
+// Cont resumes a paused guest.
+func (m *Monitor) Cont() error {
+	_, err := m.Query("cont", nil)
+	return err
+}
+
+// Stop pauses guest execution without terminating qemu.
+func (m *Monitor) Stop() error {
+	_, err := m.Query("stop", nil)
+	return err
+}
+
+// SystemPowerdown requests a graceful ACPI shutdown of the guest.
+func (m *Monitor) SystemPowerdown() error {
+	_, err := m.Query("system_powerdown", nil)
+	return err
+}
+
+// SnapshotSave saves a full live VM snapshot (memory + all disks) under
+// tag, into whichever disk qemu was given as its boot disk. It goes
+// through the "savevm" human monitor command rather than the QMP
+// snapshot-save job, since savevm blocks until the snapshot is actually
+// on disk instead of just having queued a background job.
+func (m *Monitor) SnapshotSave(tag string) error {
+	ret, err := m.Query("human-monitor-command", map[string]interface{}{
+		"command-line": "savevm " + tag,
+	})
+	if err != nil {
+		return err
+	}
+	// savevm reports errors as plain text in the HMP reply rather than a
+	// QMP error object.
+	var out string
+	if jsonErr := json.Unmarshal(ret, &out); jsonErr == nil && out != "" {
+		return errors.Errorf("savevm %s: %s", tag, out)
+	}
+	return nil
+}
+
+// DeviceAdd hot-adds a device, e.g. for attaching a disk or NIC that
+// wasn't on the initial qemu command line.
+func (m *Monitor) DeviceAdd(driver, id string, props map[string]interface{}) error {
+	args := map[string]interface{}{"driver": driver, "id": id}
+	for k, v := range props {
+		args[k] = v
+	}
+	_, err := m.Query("device_add", args)
+	return err
+}
+
+// QueryStatus returns qemu's view of the guest's run state, useful for
+// capturing a dump of why a guest appears stuck.
+func (m *Monitor) QueryStatus() (json.RawMessage, error) {
+	return m.Query("query-status", nil)
+}
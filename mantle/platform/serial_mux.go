@@ -0,0 +1,54 @@
+// Copyright 2020 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// SerialMux fans in the serial consoles of several instances into one
+// stream, prefixing each line with the hostname it came from. It's used
+// by multi-instance cluster launches where watching N separate consoles
+// isn't practical.
+type SerialMux struct {
+	out io.Writer
+	sem chan struct{}
+}
+
+// NewSerialMux creates a multiplexer that writes tagged lines to out.
+func NewSerialMux(out io.Writer) *SerialMux {
+	return &SerialMux{out: out, sem: make(chan struct{}, 1)}
+}
+
+// Add starts copying lines from console, tagged with hostname, until
+// console is closed. It returns immediately; copying happens in the
+// background. A nil console (a node whose instance exposes none) is a
+// harmless no-op rather than a nil-pointer panic in the background
+// goroutine.
+func (m *SerialMux) Add(hostname string, console io.Reader) {
+	if console == nil {
+		return
+	}
+	go func() {
+		scanner := bufio.NewScanner(console)
+		for scanner.Scan() {
+			m.sem <- struct{}{}
+			fmt.Fprintf(m.out, "[%s] %s\n", hostname, scanner.Text())
+			<-m.sem
+		}
+	}()
+}
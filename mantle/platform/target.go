@@ -0,0 +1,179 @@
+// Copyright 2020 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package platform
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/coreos/mantle/platform/conf"
+)
+
+// Target abstracts over the different places a CoreOS instance can be
+// launched from qemuexec/run: a local qemu process or a host that's
+// already up and reachable over SSH. It lets callers like cmdQemuExec
+// share the Ignition/kargs/console/bind flow instead of special-casing
+// qemu everywhere.
+//
+// Cloud targets (AWS/GCP) are intentionally out of scope here: wiring
+// them up needs the equivalent of mantle's kola cloud platform packages
+// (credentials, AMI/image lookup, security groups, ...), none of which
+// exist in this checkout. NewTarget rejects them with a clear error
+// instead of pretending to support them.
+type Target interface {
+	// Start launches (or attaches to) an instance using the given Ignition
+	// config.
+	Start(ctx context.Context, config *conf.Conf) error
+	// SerialConsole returns the instance's serial console, or nil if this
+	// target doesn't expose one (e.g. a bare SSH attach).
+	SerialConsole() io.ReadCloser
+	// SSH opens a connection to the instance's SSH port.
+	SSH() (net.Conn, error)
+	// Stop tears down the instance, or disconnects without touching it if
+	// this target only attached to something already running.
+	Stop() error
+}
+
+// TargetName identifies a Target implementation, as chosen with --target.
+type TargetName string
+
+const (
+	TargetQemu TargetName = "qemu"
+	TargetSSH  TargetName = "ssh"
+	TargetAWS  TargetName = "aws"
+	TargetGCP  TargetName = "gcp"
+)
+
+// NewTarget resolves a --target flag value to a Target implementation.
+// SSH targets need NewSSHTarget instead, since they take a host/port.
+//
+// Known gap: the request behind this package asked for qemu, ssh, and at
+// least one cloud target. TargetAWS/TargetGCP are accepted here (rather
+// than rejected by the flag parser) so --target=aws/gcp fails with this
+// explicit "not implemented in this checkout" error instead of "unknown
+// target" — but neither is actually implemented. Doing so needs the
+// credentials/AMI-image-lookup/security-group glue from mantle's kola
+// cloud platform packages, which aren't part of this checkout.
+func NewTarget(name TargetName, builder *QemuBuilder) (Target, error) {
+	switch name {
+	case TargetQemu, "":
+		return &qemuTarget{builder: builder}, nil
+	case TargetSSH:
+		return nil, errors.New("--target=ssh requires --target-ssh-host; use NewSSHTarget")
+	case TargetAWS, TargetGCP:
+		return nil, errors.Errorf("--target=%s is not implemented in this checkout: needs mantle's cloud platform packages", name)
+	default:
+		return nil, errors.Errorf("unknown target %q", name)
+	}
+}
+
+// qemuTarget is the default Target, backed by the local QemuBuilder flow
+// that already exists in qemuexec.
+type qemuTarget struct {
+	builder *QemuBuilder
+	inst    Instance
+}
+
+func (t *qemuTarget) Start(ctx context.Context, config *conf.Conf) error {
+	if config != nil {
+		t.builder.SetConfig(config)
+	}
+	inst, err := t.builder.Exec()
+	if err != nil {
+		return err
+	}
+	t.inst = inst
+	return nil
+}
+
+func (t *qemuTarget) SerialConsole() io.ReadCloser {
+	if t.inst == nil {
+		return nil
+	}
+	return t.inst.SerialConsole()
+}
+
+func (t *qemuTarget) SSH() (net.Conn, error) {
+	if t.inst == nil {
+		return nil, errors.New("instance not started")
+	}
+	return net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", t.inst.SSHPort()))
+}
+
+func (t *qemuTarget) Stop() error {
+	if t.inst == nil {
+		return nil
+	}
+	t.inst.Destroy()
+	return nil
+}
+
+// sshTarget connects to an already-provisioned host instead of booting a
+// new one; it's used for bare-metal and for cloud instances provisioned
+// out of band.
+type sshTarget struct {
+	host string
+	port int
+	conn net.Conn
+}
+
+// NewSSHTarget builds a Target that talks to a host that's already up,
+// rather than launching a new instance.
+func NewSSHTarget(host string, port int) Target {
+	return &sshTarget{host: host, port: port}
+}
+
+// Start for sshTarget just verifies the host is reachable; it can't
+// apply config since the host is already running, so any non-nil
+// Ignition config (even an empty one) is rejected rather than silently
+// ignored.
+func (t *sshTarget) Start(ctx context.Context, config *conf.Conf) error {
+	if config != nil {
+		return errors.New("--target=ssh attaches to an already-running host; it cannot apply an Ignition config")
+	}
+	d := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", t.host, t.port))
+	if err != nil {
+		return errors.Wrapf(err, "connecting to %s:%d", t.host, t.port)
+	}
+	t.conn = conn
+	return nil
+}
+
+// SerialConsole is unavailable for a bare SSH attach; there's no local
+// qemu process to read it from.
+func (t *sshTarget) SerialConsole() io.ReadCloser {
+	return nil
+}
+
+// SSH returns the connection Start opened; it does not dial a new one.
+func (t *sshTarget) SSH() (net.Conn, error) {
+	if t.conn == nil {
+		return nil, errors.New("not connected; call Start first")
+	}
+	return t.conn, nil
+}
+
+func (t *sshTarget) Stop() error {
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.Close()
+}